@@ -0,0 +1,204 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/cloud/storage"
+)
+
+// A sentinel for Tombstone.Generation meaning "we don't know what generation
+// of the name was removed", e.g. because NoteRemoval was called for a name
+// that had never been seen in a listing or noted as added. Such a tombstone
+// hides the name unconditionally until it expires, rather than comparing
+// generations.
+const unknownGeneration = int64(-1)
+
+// Tombstone is a record of a name that NoteRemoval has hidden from future
+// listings of its parent directory.
+type Tombstone struct {
+	RemovedAt  time.Time
+	Generation int64
+}
+
+// ListingCacheEntry is everything a ListingCache stores about a single
+// directory: the most recent raw listing fetched from GCS (if any), and any
+// local overrides noted via NoteAddition/NoteRemoval.
+//
+// Objects and Subdirs are a flat listing's raw results; Additions,
+// SubdirAdditions, and Removals are overrides layered on top of them by
+// ListingProxy at read time. A ListingCache implementation is not expected
+// to interpret or merge these -- it simply stores and returns them.
+type ListingCacheEntry struct {
+	// Whether Objects/Subdirs/Timestamp below have ever been populated by a
+	// call to ListingCache.Put.
+	HaveListing bool
+
+	// The result of the most recent successful GCS listing of this
+	// directory.
+	Objects []*storage.Object
+	Subdirs []string
+
+	// The clock time at which Objects/Subdirs were fetched. Freshness is
+	// judged by ListingProxy comparing this against its own
+	// timeutil.Clock, not by the cache implementation, so that behavior is
+	// consistent regardless of backing store (including under a
+	// timeutil.SimulatedClock in tests).
+	Timestamp time.Time
+
+	// Names noted locally as added via NoteNewObject, keyed by object name.
+	Additions map[string]*storage.Object
+
+	// Names noted locally as added via NoteNewSubdirectory.
+	SubdirAdditions map[string]struct{}
+
+	// Tombstones for names noted locally as removed via NoteRemoval, keyed
+	// by name (object or sub-directory).
+	Removals map[string]Tombstone
+}
+
+// ListingCache is the pluggable backing store for everything ListingProxy
+// knows about the directories it proxies. Implementations must be safe for
+// concurrent use.
+//
+// A ListingCache is pure storage: it does not interpret TTLs, tombstone
+// generations, or how overrides should be merged with a raw listing -- that
+// reconciliation logic lives in ListingProxy and is applied uniformly on
+// top of whatever a ListingCache returns from Get.
+type ListingCache interface {
+	// Get returns the entry currently stored for dir, if any.
+	Get(dir string) (entry ListingCacheEntry, ok bool)
+
+	// Put replaces the raw-listing portion (Objects, Subdirs, Timestamp) of
+	// dir's entry, leaving any local overrides untouched. ttl is advisory:
+	// implementations backed by a store with native expiry (e.g. Redis) may
+	// use it to bound how long they hold onto the entry, but correctness
+	// must not depend on it -- ListingProxy always re-checks Timestamp
+	// against its own clock.
+	Put(dir string, entry ListingCacheEntry, ttl time.Duration) error
+
+	// NoteAddition records that name should override dir's listing. If o is
+	// nil, name is a sub-directory addition; otherwise it is an object
+	// addition for o. Either way this clears any pending removal for name.
+	NoteAddition(dir string, name string, o *storage.Object) error
+
+	// NoteRemoval records a tombstone for name within dir, clearing any
+	// pending addition for name.
+	NoteRemoval(dir string, name string, ts Tombstone) error
+
+	// Invalidate drops any cached raw listing for dir (but not its local
+	// overrides), forcing the next List to go back to GCS.
+	Invalidate(dir string) error
+}
+
+// ensureOverrideMaps initializes any nil override maps on entry so callers
+// can assign into them unconditionally.
+func ensureOverrideMaps(entry *ListingCacheEntry) {
+	if entry.Additions == nil {
+		entry.Additions = make(map[string]*storage.Object)
+	}
+
+	if entry.SubdirAdditions == nil {
+		entry.SubdirAdditions = make(map[string]struct{})
+	}
+
+	if entry.Removals == nil {
+		entry.Removals = make(map[string]Tombstone)
+	}
+}
+
+// inMemoryListingCache is the default ListingCache: private, per-process
+// state, exactly as ListingProxy held it before ListingCache existed.
+type inMemoryListingCache struct {
+	mu      sync.Mutex
+	entries map[string]ListingCacheEntry
+}
+
+// NewInMemoryListingCache returns a ListingCache backed by process memory.
+// This is what NewListingProxy uses if no cache is supplied.
+func NewInMemoryListingCache() ListingCache {
+	return &inMemoryListingCache{
+		entries: make(map[string]ListingCacheEntry),
+	}
+}
+
+func (c *inMemoryListingCache) Get(dir string) (entry ListingCacheEntry, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok = c.entries[dir]
+	return
+}
+
+func (c *inMemoryListingCache) Put(
+	dir string,
+	entry ListingCacheEntry,
+	ttl time.Duration) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	existing := c.entries[dir]
+	existing.HaveListing = true
+	existing.Objects = entry.Objects
+	existing.Subdirs = entry.Subdirs
+	existing.Timestamp = entry.Timestamp
+	c.entries[dir] = existing
+
+	return
+}
+
+func (c *inMemoryListingCache) NoteAddition(
+	dir string,
+	name string,
+	o *storage.Object) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.entries[dir]
+	ensureOverrideMaps(&entry)
+	delete(entry.Removals, name)
+
+	if o == nil {
+		entry.SubdirAdditions[name] = struct{}{}
+	} else {
+		entry.Additions[name] = o
+	}
+
+	c.entries[dir] = entry
+
+	return
+}
+
+func (c *inMemoryListingCache) NoteRemoval(
+	dir string,
+	name string,
+	ts Tombstone) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.entries[dir]
+	ensureOverrideMaps(&entry)
+	delete(entry.Additions, name)
+	delete(entry.SubdirAdditions, name)
+	entry.Removals[name] = ts
+	c.entries[dir] = entry
+
+	return
+}
+
+func (c *inMemoryListingCache) Invalidate(dir string) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.entries[dir]
+	entry.HaveListing = false
+	entry.Objects = nil
+	entry.Subdirs = nil
+	entry.Timestamp = time.Time{}
+	c.entries[dir] = entry
+
+	return
+}
@@ -0,0 +1,191 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"google.golang.org/cloud/storage"
+)
+
+// bboltListingsBucket is the sole top-level bbolt bucket used by
+// BboltListingCache, holding one gob-encoded ListingCacheEntry per
+// directory name.
+var bboltListingsBucket = []byte("listings")
+
+// BboltListingCache is a ListingCache backed by a bbolt database file on
+// disk, so that a mount's listing cache and local overrides survive a
+// gcsfuse restart instead of every mount starting cold against GCS.
+type BboltListingCache struct {
+	db *bbolt.DB
+}
+
+// NewBboltListingCache opens (creating if necessary) a bbolt-backed
+// ListingCache for the bucket named bucketName, stored at
+// $XDG_CACHE_HOME/gcsfuse/<bucketName>.db (falling back to
+// ~/.cache/gcsfuse/<bucketName>.db if XDG_CACHE_HOME is unset). The
+// returned cache owns the underlying file and must be closed with Close
+// when no longer needed.
+func NewBboltListingCache(bucketName string) (cache *BboltListingCache, err error) {
+	dir, err := listingCacheDir()
+	if err != nil {
+		err = fmt.Errorf("listingCacheDir: %v", err)
+		return
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	path := filepath.Join(dir, bucketName+".db")
+
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		err = fmt.Errorf("bbolt.Open(%q): %v", path, err)
+		return
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) (err error) {
+		_, err = tx.CreateBucketIfNotExists(bboltListingsBucket)
+		return
+	})
+
+	if err != nil {
+		db.Close()
+		err = fmt.Errorf("CreateBucketIfNotExists: %v", err)
+		return
+	}
+
+	cache = &BboltListingCache{db: db}
+	return
+}
+
+func listingCacheDir() (dir string, err error) {
+	if xdg := os.Getenv("XDG_CACHE_HOME"); xdg != "" {
+		dir = filepath.Join(xdg, "gcsfuse")
+		return
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return
+	}
+
+	dir = filepath.Join(home, ".cache", "gcsfuse")
+	return
+}
+
+// Close releases the underlying bbolt database file.
+func (c *BboltListingCache) Close() error {
+	return c.db.Close()
+}
+
+func (c *BboltListingCache) get(
+	tx *bbolt.Tx,
+	dir string) (entry ListingCacheEntry, ok bool) {
+	raw := tx.Bucket(bboltListingsBucket).Get([]byte(dir))
+	if raw == nil {
+		return
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&entry); err != nil {
+		return
+	}
+
+	ok = true
+	return
+}
+
+func (c *BboltListingCache) put(
+	tx *bbolt.Tx,
+	dir string,
+	entry ListingCacheEntry) (err error) {
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return
+	}
+
+	return tx.Bucket(bboltListingsBucket).Put([]byte(dir), buf.Bytes())
+}
+
+func (c *BboltListingCache) Get(dir string) (entry ListingCacheEntry, ok bool) {
+	c.db.View(func(tx *bbolt.Tx) error {
+		entry, ok = c.get(tx, dir)
+		return nil
+	})
+
+	return
+}
+
+func (c *BboltListingCache) Put(
+	dir string,
+	entry ListingCacheEntry,
+	ttl time.Duration) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		existing, _ := c.get(tx, dir)
+		existing.HaveListing = true
+		existing.Objects = entry.Objects
+		existing.Subdirs = entry.Subdirs
+		existing.Timestamp = entry.Timestamp
+
+		return c.put(tx, dir, existing)
+	})
+}
+
+func (c *BboltListingCache) NoteAddition(
+	dir string,
+	name string,
+	o *storage.Object) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		entry, _ := c.get(tx, dir)
+		ensureOverrideMaps(&entry)
+		delete(entry.Removals, name)
+
+		if o == nil {
+			entry.SubdirAdditions[name] = struct{}{}
+		} else {
+			entry.Additions[name] = o
+		}
+
+		return c.put(tx, dir, entry)
+	})
+}
+
+func (c *BboltListingCache) NoteRemoval(
+	dir string,
+	name string,
+	ts Tombstone) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		entry, _ := c.get(tx, dir)
+		ensureOverrideMaps(&entry)
+		delete(entry.Additions, name)
+		delete(entry.SubdirAdditions, name)
+		entry.Removals[name] = ts
+
+		return c.put(tx, dir, entry)
+	})
+}
+
+func (c *BboltListingCache) Invalidate(dir string) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		entry, ok := c.get(tx, dir)
+		if !ok {
+			return nil
+		}
+
+		entry.HaveListing = false
+		entry.Objects = nil
+		entry.Subdirs = nil
+		entry.Timestamp = time.Time{}
+
+		return c.put(tx, dir, entry)
+	})
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/gcloud/gcs/mock_gcs"
+	"github.com/jacobsa/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcsfuse/timeutil"
+	. "github.com/jacobsa/oglematchers"
+	"github.com/jacobsa/oglemock"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+func TestBboltListingCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type BboltListingCacheTest struct {
+	dirName          string
+	cacheHome        string
+	prevCacheHome    string
+	prevCacheHomeSet bool
+	bucketName       string
+	bucket           mock_gcs.MockBucket
+	clock            timeutil.SimulatedClock
+}
+
+var _ SetUpInterface = &BboltListingCacheTest{}
+var _ TearDownInterface = &BboltListingCacheTest{}
+
+func init() { RegisterTestSuite(&BboltListingCacheTest{}) }
+
+func (t *BboltListingCacheTest) SetUp(ti *TestInfo) {
+	t.dirName = "some/dir/"
+	t.bucketName = "bucket"
+	t.bucket = mock_gcs.NewMockBucket(ti.MockController, t.bucketName)
+
+	var err error
+	t.cacheHome, err = ioutil.TempDir("", "listing_cache_bbolt_test")
+	AssertEq(nil, err)
+
+	t.prevCacheHome, t.prevCacheHomeSet = os.LookupEnv("XDG_CACHE_HOME")
+	os.Setenv("XDG_CACHE_HOME", t.cacheHome)
+}
+
+func (t *BboltListingCacheTest) TearDown() {
+	if t.prevCacheHomeSet {
+		os.Setenv("XDG_CACHE_HOME", t.prevCacheHome)
+	} else {
+		os.Unsetenv("XDG_CACHE_HOME")
+	}
+
+	os.RemoveAll(t.cacheHome)
+}
+
+func (t *BboltListingCacheTest) newProxy() (
+	lp *gcsproxy.ListingProxy,
+	cache *gcsproxy.BboltListingCache) {
+	cache, err := gcsproxy.NewBboltListingCache(t.bucketName)
+	AssertEq(nil, err)
+
+	lp, err = gcsproxy.NewListingProxyWithCache(t.bucket, &t.clock, t.dirName, cache)
+	AssertEq(nil, err)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Test functions
+////////////////////////////////////////////////////////////////////////
+
+func (t *BboltListingCacheTest) SurvivesRestart() {
+	// Populate the cache via one "process".
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: t.dirName + "foo"},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	firstProxy, firstCache := t.newProxy()
+	objects, _, err := firstProxy.List(context.Background())
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre(listing.Results[0]))
+
+	// Simulate a restart: close the database file as the old process would
+	// on exit, then build a brand new ListingProxy and BboltListingCache
+	// pointed at the same on-disk database, without advancing the clock
+	// past ListingProxy_ListingCacheTTL.
+	AssertEq(nil, firstCache.Close())
+	secondProxy, secondCache := t.newProxy()
+	defer secondCache.Close()
+
+	// No further call to ListObjects should be necessary.
+	objects, _, err = secondProxy.List(context.Background())
+
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre(listing.Results[0]))
+}
+
+func (t *BboltListingCacheTest) SurvivesRestart_ListRecursiveDescendant() {
+	// Walk the tree via one "process": the top level has a single
+	// sub-directory, which is listed in turn.
+	topListing := &storage.Objects{
+		Prefixes: []string{t.dirName + "sub/"},
+	}
+	subListing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: t.dirName + "sub/foo"},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(topListing, nil)).
+		WillOnce(oglemock.Return(subListing, nil))
+
+	firstProxy, firstCache := t.newProxy()
+
+	var dirs []string
+	err := firstProxy.Walk(
+		context.Background(),
+		gcsproxy.ListRecursiveOptions{},
+		func(dir string, objects []*storage.Object, subdirs []string) error {
+			dirs = append(dirs, dir)
+			return nil
+		})
+
+	AssertEq(nil, err)
+	ExpectThat(dirs, ElementsAre(t.dirName, t.dirName+"sub/"))
+
+	// Simulate a restart, as in SurvivesRestart above, without advancing the
+	// clock past ListingProxy_WalkCacheTTL.
+	AssertEq(nil, firstCache.Close())
+	secondProxy, secondCache := t.newProxy()
+	defer secondCache.Close()
+
+	// Walking again should need no further round trips to the bucket --
+	// including for "sub/", which only the walk (not a flat List) ever
+	// visited -- since listOneLevel's descendant listings are stored in the
+	// same on-disk cache as the top-level entry.
+	dirs = nil
+	err = secondProxy.Walk(
+		context.Background(),
+		gcsproxy.ListRecursiveOptions{},
+		func(dir string, objects []*storage.Object, subdirs []string) error {
+			dirs = append(dirs, dir)
+			return nil
+		})
+
+	AssertEq(nil, err)
+	ExpectThat(dirs, ElementsAre(t.dirName, t.dirName+"sub/"))
+}
+
+func (t *BboltListingCacheTest) Invalidate_DropsListingButNotOverrides() {
+	entry := gcsproxy.ListingCacheEntry{
+		HaveListing: true,
+		Objects:     []*storage.Object{&storage.Object{Name: t.dirName + "foo"}},
+	}
+
+	_, cache := t.newProxy()
+
+	AssertEq(nil, cache.Put(t.dirName, entry, gcsproxy.ListingProxy_ListingCacheTTL))
+	AssertEq(nil, cache.NoteAddition(t.dirName, "bar/", nil))
+
+	AssertEq(nil, cache.Invalidate(t.dirName))
+
+	got, ok := cache.Get(t.dirName)
+	AssertTrue(ok)
+	ExpectFalse(got.HaveListing)
+	ExpectThat(got.Objects, ElementsAre())
+	_, stillThere := got.SubdirAdditions["bar/"]
+	ExpectTrue(stillThere)
+}
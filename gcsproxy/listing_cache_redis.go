@@ -0,0 +1,166 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/cloud/storage"
+)
+
+// RedisListingCache is a ListingCache backed by Redis, so that multiple
+// gcsfuse mounts of the same bucket -- potentially on different hosts --
+// can share one listing cache instead of each re-listing directories the
+// others have already fetched.
+//
+// Reads and writes against a single directory's entry are not atomic
+// end-to-end (each is a Get followed by a Set), so concurrent NoteAddition
+// and NoteRemoval calls for the same directory from different processes can
+// race. This is weaker than the in-memory and bbolt caches, which hold a
+// lock (or a bbolt transaction) across each call's own read-modify-write,
+// though neither of those protects a sequence spanning two calls either.
+//
+// Unlike the in-memory and bbolt caches, every entry this cache writes
+// carries a native Redis expiration (Put's ttl for raw listings,
+// ListingProxy_TombstoneTTL for override-only writes), so a directory no
+// mount has touched recently is reclaimed by Redis itself rather than
+// living forever in a store that may be shared by many tenants/mounts. Since
+// the raw listing and the overrides share one key, a key's TTL only ever
+// grows (see put) so that, e.g., a listing refresh doesn't truncate a
+// longer-lived tombstone written moments before.
+type RedisListingCache struct {
+	client    *redis.Client
+	keyPrefix string
+}
+
+// NewRedisListingCache returns a ListingCache that stores entries in Redis
+// via client, namespacing keys under keyPrefix (typically something
+// bucket-specific, e.g. "gcsfuse:some-bucket:").
+func NewRedisListingCache(client *redis.Client, keyPrefix string) *RedisListingCache {
+	return &RedisListingCache{
+		client:    client,
+		keyPrefix: keyPrefix,
+	}
+}
+
+func (c *RedisListingCache) key(dir string) string {
+	return c.keyPrefix + dir
+}
+
+func (c *RedisListingCache) get(
+	ctx context.Context,
+	dir string) (entry ListingCacheEntry, ok bool) {
+	raw, err := c.client.Get(ctx, c.key(dir)).Bytes()
+	if err != nil {
+		return
+	}
+
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return
+	}
+
+	ok = true
+	return
+}
+
+func (c *RedisListingCache) put(
+	ctx context.Context,
+	dir string,
+	entry ListingCacheEntry,
+	ttl time.Duration) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %v", err)
+	}
+
+	key := c.key(dir)
+
+	// The raw listing and the overrides (Additions/Removals) share this one
+	// key, but are written under very different TTLs -- a listing refresh
+	// every ListingProxy_ListingCacheTTL vs. a tombstone meant to live for
+	// ListingProxy_TombstoneTTL. Blindly setting ttl here would let whichever
+	// call happens to run last shorten the key's expiration out from under
+	// the other's state (e.g. a List refresh a second after NoteRemoval
+	// would cut a minute-long tombstone down to a second). So the key's TTL
+	// only ever grows: never set it to less than however long it already has
+	// remaining.
+	if remaining, err := c.client.TTL(ctx, key).Result(); err == nil && remaining > ttl {
+		ttl = remaining
+	}
+
+	return c.client.Set(ctx, key, raw, ttl).Err()
+}
+
+func (c *RedisListingCache) Get(dir string) (entry ListingCacheEntry, ok bool) {
+	return c.get(context.Background(), dir)
+}
+
+func (c *RedisListingCache) Put(
+	dir string,
+	entry ListingCacheEntry,
+	ttl time.Duration) error {
+	ctx := context.Background()
+
+	existing, _ := c.get(ctx, dir)
+	existing.HaveListing = true
+	existing.Objects = entry.Objects
+	existing.Subdirs = entry.Subdirs
+	existing.Timestamp = entry.Timestamp
+
+	return c.put(ctx, dir, existing, ttl)
+}
+
+func (c *RedisListingCache) NoteAddition(
+	dir string,
+	name string,
+	o *storage.Object) error {
+	ctx := context.Background()
+
+	entry, _ := c.get(ctx, dir)
+	ensureOverrideMaps(&entry)
+	delete(entry.Removals, name)
+
+	if o == nil {
+		entry.SubdirAdditions[name] = struct{}{}
+	} else {
+		entry.Additions[name] = o
+	}
+
+	return c.put(ctx, dir, entry, ListingProxy_TombstoneTTL)
+}
+
+func (c *RedisListingCache) NoteRemoval(
+	dir string,
+	name string,
+	ts Tombstone) error {
+	ctx := context.Background()
+
+	entry, _ := c.get(ctx, dir)
+	ensureOverrideMaps(&entry)
+	delete(entry.Additions, name)
+	delete(entry.SubdirAdditions, name)
+	entry.Removals[name] = ts
+
+	return c.put(ctx, dir, entry, ListingProxy_TombstoneTTL)
+}
+
+func (c *RedisListingCache) Invalidate(dir string) error {
+	ctx := context.Background()
+
+	entry, ok := c.get(ctx, dir)
+	if !ok {
+		return nil
+	}
+
+	entry.HaveListing = false
+	entry.Objects = nil
+	entry.Subdirs = nil
+	entry.Timestamp = time.Time{}
+
+	return c.put(ctx, dir, entry, ListingProxy_TombstoneTTL)
+}
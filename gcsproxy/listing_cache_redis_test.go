@@ -0,0 +1,233 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/jacobsa/gcloud/gcs/mock_gcs"
+	"github.com/jacobsa/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcsfuse/timeutil"
+	. "github.com/jacobsa/oglematchers"
+	"github.com/jacobsa/oglemock"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+func TestRedisListingCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type RedisListingCacheTest struct {
+	dirName    string
+	bucketName string
+	bucket     mock_gcs.MockBucket
+	clock      timeutil.SimulatedClock
+	server     *miniredis.Miniredis
+}
+
+var _ SetUpInterface = &RedisListingCacheTest{}
+var _ TearDownInterface = &RedisListingCacheTest{}
+
+func init() { RegisterTestSuite(&RedisListingCacheTest{}) }
+
+func (t *RedisListingCacheTest) SetUp(ti *TestInfo) {
+	t.dirName = "some/dir/"
+	t.bucketName = "bucket"
+	t.bucket = mock_gcs.NewMockBucket(ti.MockController, t.bucketName)
+
+	var err error
+	t.server, err = miniredis.Run()
+	AssertEq(nil, err)
+}
+
+func (t *RedisListingCacheTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *RedisListingCacheTest) newProxy() (
+	lp *gcsproxy.ListingProxy,
+	cache *gcsproxy.RedisListingCache) {
+	client := redis.NewClient(&redis.Options{Addr: t.server.Addr()})
+	cache = gcsproxy.NewRedisListingCache(client, "gcsfuse:"+t.bucketName+":")
+
+	lp, err := gcsproxy.NewListingProxyWithCache(t.bucket, &t.clock, t.dirName, cache)
+	AssertEq(nil, err)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Test functions
+////////////////////////////////////////////////////////////////////////
+
+func (t *RedisListingCacheTest) SurvivesRestart() {
+	// Populate the cache via one "process".
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: t.dirName + "foo"},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	firstProxy, _ := t.newProxy()
+	objects, _, err := firstProxy.List(context.Background())
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre(listing.Results[0]))
+
+	// Simulate a restart: build a brand new ListingProxy and
+	// RedisListingCache pointed at the same Redis server, without advancing
+	// the clock past ListingProxy_ListingCacheTTL.
+	secondProxy, _ := t.newProxy()
+
+	// No further call to ListObjects should be necessary.
+	objects, _, err = secondProxy.List(context.Background())
+
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre(listing.Results[0]))
+}
+
+func (t *RedisListingCacheTest) NoteRemoval_SharedAcrossInstances() {
+	// List once, seeing the object via one proxy.
+	name := t.dirName + "foo"
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: name, Generation: 5},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	firstProxy, _ := t.newProxy()
+	_, _, err := firstProxy.List(context.Background())
+	AssertEq(nil, err)
+
+	err = firstProxy.NoteRemoval(name)
+	AssertEq(nil, err)
+
+	// A second proxy sharing the same Redis server should see the removal
+	// via the still-fresh cached listing, even without ever having listed
+	// the directory itself.
+	secondProxy, _ := t.newProxy()
+	objects, _, err := secondProxy.List(context.Background())
+
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre())
+}
+
+func (t *RedisListingCacheTest) NoteRemoval_SurvivesSubsequentListingRefresh() {
+	name := t.dirName + "foo"
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: name, Generation: 5},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	proxy, cache := t.newProxy()
+	_, _, err := proxy.List(context.Background())
+	AssertEq(nil, err)
+
+	err = proxy.NoteRemoval(name)
+	AssertEq(nil, err)
+
+	// Advance both clocks past the (much shorter) listing TTL, as if some
+	// wall-clock time passed between the removal and the next List call.
+	t.clock.AdvanceTime(gcsproxy.ListingProxy_ListingCacheTTL + time.Millisecond)
+	t.server.FastForward(gcsproxy.ListingProxy_ListingCacheTTL + time.Millisecond)
+
+	// This List is stale, so it refreshes from GCS -- which still reports
+	// the "removed" name at the same generation, as an eventually-consistent
+	// index might -- and Puts the fresh listing back into the same Redis
+	// key NoteRemoval's tombstone lives in.
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	objects, _, err := proxy.List(context.Background())
+	AssertEq(nil, err)
+
+	// The tombstone (same generation, so not a resurrection) should still
+	// hide the name -- i.e. the Put above must not have shortened the key's
+	// TTL down from ListingProxy_TombstoneTTL to ListingProxy_ListingCacheTTL.
+	ExpectThat(objects, ElementsAre())
+
+	// Advance further, past where the listing-refresh Put's own TTL would
+	// have expired the key had it won, and confirm the key -- tombstone
+	// included -- is still in Redis at all.
+	t.server.FastForward(2 * gcsproxy.ListingProxy_ListingCacheTTL)
+	_, ok := cache.Get(t.dirName)
+	AssertTrue(ok)
+}
+
+func (t *RedisListingCacheTest) Invalidate_DropsListingButNotOverrides() {
+	_, cache := t.newProxy()
+
+	entry := gcsproxy.ListingCacheEntry{
+		HaveListing: true,
+		Objects: []*storage.Object{
+			&storage.Object{Name: t.dirName + "foo"},
+		},
+	}
+
+	AssertEq(nil, cache.Put(t.dirName, entry, gcsproxy.ListingProxy_ListingCacheTTL))
+	AssertEq(nil, cache.NoteAddition(t.dirName, "bar/", nil))
+
+	AssertEq(nil, cache.Invalidate(t.dirName))
+
+	got, ok := cache.Get(t.dirName)
+	AssertTrue(ok)
+	ExpectFalse(got.HaveListing)
+	ExpectThat(got.Objects, ElementsAre())
+	_, stillThere := got.SubdirAdditions["bar/"]
+	ExpectTrue(stillThere)
+}
+
+func (t *RedisListingCacheTest) Put_EntryExpiresAfterTTL() {
+	_, cache := t.newProxy()
+
+	err := cache.Put(
+		t.dirName,
+		gcsproxy.ListingCacheEntry{HaveListing: true},
+		time.Second)
+	AssertEq(nil, err)
+
+	_, ok := cache.Get(t.dirName)
+	AssertTrue(ok)
+
+	// Real expiration was passed to Redis, rather than the entry living
+	// forever, so once miniredis's clock passes the TTL the key is gone.
+	t.server.FastForward(time.Second + time.Millisecond)
+
+	_, ok = cache.Get(t.dirName)
+	ExpectFalse(ok)
+}
+
+func (t *RedisListingCacheTest) NoteRemoval_EntryExpiresAfterTombstoneTTL() {
+	_, cache := t.newProxy()
+
+	err := cache.NoteRemoval(t.dirName, "foo", gcsproxy.Tombstone{})
+	AssertEq(nil, err)
+
+	_, ok := cache.Get(t.dirName)
+	AssertTrue(ok)
+
+	// An override-only write like NoteRemoval isn't handed a ttl directly,
+	// but it should still bound the entry's lifetime (to
+	// ListingProxy_TombstoneTTL) rather than leaving it in Redis forever.
+	t.server.FastForward(gcsproxy.ListingProxy_TombstoneTTL + time.Millisecond)
+
+	_, ok = cache.Get(t.dirName)
+	ExpectFalse(ok)
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors returned (wrapped in a *ListingError) by ListingProxy's
+// methods and by listDirectory, so that callers can dispatch on the kind of
+// failure via errors.Is instead of matching substrings of Error().
+var (
+	// A name was given that does not fall within the directory a
+	// ListingProxy (or listDirectory call) is responsible for.
+	ErrNotDescendant = errors.New("not a descendant")
+
+	// A sub-directory name was given that names a descendant more than one
+	// level below the directory a ListingProxy is responsible for.
+	ErrNotDirectDescendant = errors.New("not a direct descendant")
+
+	// A directory name was given that is neither empty nor ends in a slash.
+	ErrIllegalDirectoryName = errors.New("illegal directory name")
+
+	// An object name was given that is empty or ends in a slash, so cannot
+	// name an object.
+	ErrIllegalObjectName = errors.New("illegal object name")
+
+	// A sub-directory name was given that does not end in a slash.
+	ErrIllegalSubDirectoryName = errors.New("illegal sub-directory name")
+)
+
+// ListingError wraps one of the sentinel errors above with the operation and
+// name involved, for a useful Error() string while still being unwrappable
+// via errors.Is and errors.As.
+type ListingError struct {
+	// The method or function in which the error was encountered, e.g.
+	// "NoteNewObject" or "List".
+	Op string
+
+	// The name that provoked the error.
+	Name string
+
+	// One of the sentinel errors above, or, for a failed ListObjects call
+	// during List, the error returned by the bucket.
+	Cause error
+}
+
+func (e *ListingError) Error() string {
+	return fmt.Sprintf("%s: %q: %v", e.Op, e.Name, e.Cause)
+}
+
+func (e *ListingError) Unwrap() error {
+	return e.Cause
+}
@@ -0,0 +1,564 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcsfuse/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+// How long we cache the result of a successful listing of a directory from
+// GCS before requiring a fresh round trip.
+//
+// This is exported for use by tests.
+const ListingProxy_ListingCacheTTL = time.Second
+
+// How long a walk performed by ListRecursive is willing to reuse a page
+// fetched for some other purpose (e.g. a recent flat List) before it goes
+// back to GCS for that directory. Currently the same as the flat listing
+// TTL; kept as a separate constant since the two are conceptually distinct
+// knobs.
+const ListingProxy_WalkCacheTTL = ListingProxy_ListingCacheTTL
+
+// How long a tombstone left behind by NoteRemoval hides a name from List,
+// even if GCS keeps returning it. This is independent of
+// ListingProxy_ListingCacheTTL: a listing cache entry can be refreshed many
+// times over while a single tombstone for a stubbornly-stale name is still
+// in effect.
+//
+// This is exported for use by tests.
+const ListingProxy_TombstoneTTL = time.Minute
+
+// PendingTombstone describes one outstanding tombstone left behind by
+// NoteRemoval, for debugging. See ListingProxy.PendingTombstones.
+type PendingTombstone struct {
+	Name string
+
+	// The time at which the name was most recently removed.
+	RemovedAt time.Time
+
+	// The generation that was observed to be removed, or unknownGeneration
+	// (-1) if none was known at the time of removal.
+	Generation int64
+
+	// Whether this tombstone is past ListingProxy_TombstoneTTL and so is no
+	// longer being honored.
+	Expired bool
+}
+
+// ListingProxy caches the result of listing a single directory in a GCS
+// bucket, reconciling the eventually-consistent view that GCS provides with
+// local knowledge of objects and sub-directories that have been created or
+// removed but may not yet be reflected in a listing.
+//
+// The flat listing cache and local overrides are held in a pluggable
+// ListingCache (see NewListingProxyWithCache); by default this is an
+// in-memory cache private to this ListingProxy, as it always has been.
+//
+// It is safe for concurrent use.
+type ListingProxy struct {
+	bucket gcs.Bucket
+	clock  timeutil.Clock
+	cache  ListingCache
+
+	// dirName is what List, NoteNewObject, NoteNewSubdirectory, and
+	// NoteRemoval accept and return names relative to. bucketPrefix is an
+	// invisible root prepended to it (and to every name derived from it)
+	// whenever this proxy talks to GCS, and to the directory key under which
+	// lp.cache stores this directory's entry, so that a ListingProxy can
+	// proxy a sub-tree of a bucket without every caller having to wrap and
+	// unwrap bucketPrefix by hand. Names stored inside that entry are kept
+	// without bucketPrefix. It is empty unless constructed via
+	// NewListingProxyForPrefix.
+	bucketPrefix string
+	dirName      string
+
+	// refreshMu serializes any read-then-write sequence this proxy performs
+	// against lp.cache's entry for fullDirName(): List's "check staleness ->
+	// refresh from GCS -> store", and NoteRemoval's "look up the known
+	// generation -> plant a tombstone for it". Without this, a List refresh
+	// and a NoteRemoval (or two NoteRemovals) racing each other could
+	// interleave their Get and Put/NoteRemoval calls, letting one overwrite
+	// the generation the other just observed. This only serializes calls
+	// within this process; lp.cache is responsible for its own safety
+	// across processes (e.g. two mounts sharing a RedisListingCache may
+	// still race each other).
+	refreshMu sync.Mutex
+}
+
+// NewListingProxy creates a proxy for listing the directory with the given
+// name within the supplied bucket, backed by a private in-memory cache. The
+// directory name must be empty (for the root of the bucket) or end in a
+// slash.
+func NewListingProxy(
+	bucket gcs.Bucket,
+	clock timeutil.Clock,
+	dirName string) (lp *ListingProxy, err error) {
+	return NewListingProxyWithCache(bucket, clock, dirName, NewInMemoryListingCache())
+}
+
+// NewListingProxyWithCache is like NewListingProxy, but stores its flat
+// listing cache and local overrides in cache rather than private in-memory
+// state. This allows the cache to survive restarts (e.g. BboltListingCache)
+// or to be shared across mounts of the same bucket (e.g. RedisListingCache).
+func NewListingProxyWithCache(
+	bucket gcs.Bucket,
+	clock timeutil.Clock,
+	dirName string,
+	cache ListingCache) (lp *ListingProxy, err error) {
+	return newListingProxy(bucket, clock, "", dirName, cache)
+}
+
+// NewListingProxyForPrefix is like NewListingProxy, but treats bucketPrefix
+// as an invisible root within bucket: dirName and every name accepted or
+// returned by the resulting proxy are relative to bucketPrefix, while GCS
+// only ever sees the full key bucketPrefix+dirName+... The resulting proxy
+// uses a private in-memory ListingCache. This lets a caller mount a sub-tree of a bucket
+// -- e.g. one tenant's slice of a shared multi-tenant bucket -- through the
+// same ListingProxy machinery as a whole-bucket mount, without wrapping and
+// unwrapping bucketPrefix by hand.
+func NewListingProxyForPrefix(
+	bucket gcs.Bucket,
+	clock timeutil.Clock,
+	bucketPrefix string,
+	dirName string) (lp *ListingProxy, err error) {
+	return newListingProxy(bucket, clock, bucketPrefix, dirName, NewInMemoryListingCache())
+}
+
+func newListingProxy(
+	bucket gcs.Bucket,
+	clock timeutil.Clock,
+	bucketPrefix string,
+	dirName string,
+	cache ListingCache) (lp *ListingProxy, err error) {
+	if bucketPrefix != "" && !strings.HasSuffix(bucketPrefix, "/") {
+		err = &ListingError{Op: "NewListingProxy", Name: bucketPrefix, Cause: ErrIllegalDirectoryName}
+		return
+	}
+
+	if dirName != "" && !strings.HasSuffix(dirName, "/") {
+		err = &ListingError{Op: "NewListingProxy", Name: dirName, Cause: ErrIllegalDirectoryName}
+		return
+	}
+
+	lp = &ListingProxy{
+		bucket:       bucket,
+		clock:        clock,
+		bucketPrefix: bucketPrefix,
+		dirName:      dirName,
+		cache:        cache,
+	}
+
+	return
+}
+
+// Name returns the name of the directory that this proxy lists, relative to
+// bucketPrefix (or to the bucket's root, if this proxy was not created with
+// NewListingProxyForPrefix).
+func (lp *ListingProxy) Name() string {
+	return lp.dirName
+}
+
+// fullDirName returns the full GCS key for the directory named by lp,
+// including the invisible bucketPrefix root (empty unless this proxy was
+// created with NewListingProxyForPrefix). This is what GCS and lp.cache see;
+// callers of List/NoteNewObject/NoteNewSubdirectory/NoteRemoval never do.
+func (lp *ListingProxy) fullDirName() string {
+	return lp.bucketPrefix + lp.dirName
+}
+
+// relativizeObjects strips lp.bucketPrefix from a copy of each of objects'
+// Name, leaving dirName itself intact. If lp.bucketPrefix is empty (the
+// common case), objects is returned unmodified, preserving pointer
+// identity.
+func (lp *ListingProxy) relativizeObjects(objects []*storage.Object) []*storage.Object {
+	if lp.bucketPrefix == "" {
+		return objects
+	}
+
+	relative := make([]*storage.Object, len(objects))
+	for i, o := range objects {
+		cp := *o
+		cp.Name = strings.TrimPrefix(o.Name, lp.bucketPrefix)
+		relative[i] = &cp
+	}
+
+	return relative
+}
+
+// relativizeSubdirs is relativizeObjects for sub-directory names.
+func (lp *ListingProxy) relativizeSubdirs(subdirs []string) []string {
+	if lp.bucketPrefix == "" {
+		return subdirs
+	}
+
+	relative := make([]string, len(subdirs))
+	for i, s := range subdirs {
+		relative[i] = strings.TrimPrefix(s, lp.bucketPrefix)
+	}
+
+	return relative
+}
+
+// CheckInvariants panics if any of the invariants that this type is
+// responsible for maintaining is violated. It is intended to be called by
+// tests.
+func (lp *ListingProxy) CheckInvariants() {
+	if lp.dirName != "" && !strings.HasSuffix(lp.dirName, "/") {
+		panic(fmt.Sprintf("Illegal directory name: %q", lp.dirName))
+	}
+
+	entry, ok := lp.cache.Get(lp.fullDirName())
+	if !ok {
+		return
+	}
+
+	for name := range entry.Additions {
+		if _, bad := entry.Removals[name]; bad {
+			panic(fmt.Sprintf("Name both added and removed: %q", name))
+		}
+	}
+
+	for name := range entry.SubdirAdditions {
+		if _, bad := entry.Removals[name]; bad {
+			panic(fmt.Sprintf("Name both added and removed: %q", name))
+		}
+	}
+}
+
+// List returns the objects and sub-directories that are immediate children
+// of the directory named by lp, reconciling a (possibly cached) listing from
+// GCS with anything noted locally via NoteNewObject, NoteNewSubdirectory, or
+// NoteRemoval.
+func (lp *ListingProxy) List(ctx context.Context) (
+	objects []*storage.Object,
+	subdirs []string,
+	err error) {
+	fullDir := lp.fullDirName()
+
+	entry, ok := lp.cache.Get(fullDir)
+	stale := !ok || !entry.HaveListing ||
+		lp.clock.Now().After(entry.Timestamp.Add(ListingProxy_ListingCacheTTL))
+
+	if stale {
+		entry, err = lp.refreshListing(ctx, fullDir)
+		if err != nil {
+			return
+		}
+	}
+
+	now := lp.clock.Now()
+
+	objectsByName := make(map[string]*storage.Object, len(entry.Objects))
+	for _, o := range entry.Objects {
+		if ts, tombstoned := entry.Removals[o.Name]; tombstoned &&
+			!now.After(ts.RemovedAt.Add(ListingProxy_TombstoneTTL)) {
+			// Hide the name unless this generation is strictly newer than
+			// the one the tombstone was recorded against.
+			if ts.Generation == unknownGeneration || o.Generation <= ts.Generation {
+				continue
+			}
+		}
+
+		objectsByName[o.Name] = o
+	}
+
+	subdirSet := make(map[string]struct{}, len(entry.Subdirs))
+	for _, s := range entry.Subdirs {
+		if ts, tombstoned := entry.Removals[s]; tombstoned &&
+			!now.After(ts.RemovedAt.Add(ListingProxy_TombstoneTTL)) {
+			continue
+		}
+
+		subdirSet[s] = struct{}{}
+	}
+
+	for name, o := range entry.Additions {
+		objectsByName[name] = o
+	}
+
+	for name := range entry.SubdirAdditions {
+		subdirSet[name] = struct{}{}
+	}
+
+	objects = make([]*storage.Object, 0, len(objectsByName))
+	for _, o := range objectsByName {
+		objects = append(objects, o)
+	}
+
+	subdirs = make([]string, 0, len(subdirSet))
+	for name := range subdirSet {
+		subdirs = append(subdirs, name)
+	}
+
+	return
+}
+
+// refreshListing fetches a fresh listing of fullDir from GCS and stores it
+// in lp.cache, returning the resulting entry. It holds refreshMu for the
+// duration, so that a caller of List that loses the race to a sibling call
+// simply waits here and then re-checks the cache (now fresh, courtesy of
+// the winner) rather than also hitting GCS.
+func (lp *ListingProxy) refreshListing(
+	ctx context.Context,
+	fullDir string) (entry ListingCacheEntry, err error) {
+	lp.refreshMu.Lock()
+	defer lp.refreshMu.Unlock()
+
+	entry, ok := lp.cache.Get(fullDir)
+	stillStale := !ok || !entry.HaveListing ||
+		lp.clock.Now().After(entry.Timestamp.Add(ListingProxy_ListingCacheTTL))
+
+	if !stillStale {
+		return
+	}
+
+	var fresh ListingCacheEntry
+	fresh.Objects, fresh.Subdirs, err = listDirectory(ctx, lp.bucket, fullDir)
+	if err != nil {
+		return
+	}
+
+	fresh.Objects = lp.relativizeObjects(fresh.Objects)
+	fresh.Subdirs = lp.relativizeSubdirs(fresh.Subdirs)
+	fresh.Timestamp = lp.clock.Now()
+	if err = lp.cache.Put(fullDir, fresh, ListingProxy_ListingCacheTTL); err != nil {
+		err = fmt.Errorf("ListingCache.Put: %v", err)
+		return
+	}
+
+	entry, ok = lp.cache.Get(fullDir)
+	if !ok {
+		err = fmt.Errorf("ListingCache.Get: entry for %q vanished after Put", fullDir)
+		return
+	}
+
+	return
+}
+
+// PendingTombstones returns a snapshot of the tombstones currently recorded
+// by NoteRemoval for immediate children of the directory named by lp, for
+// debugging. The result is in no particular order, and includes tombstones
+// past ListingProxy_TombstoneTTL (see PendingTombstone.Expired) -- the cache
+// does not eagerly purge them, since filtering them out at List time is
+// equally correct and cheaper.
+func (lp *ListingProxy) PendingTombstones() (tombstones []PendingTombstone) {
+	entry, ok := lp.cache.Get(lp.fullDirName())
+	if !ok {
+		return
+	}
+
+	now := lp.clock.Now()
+	tombstones = make([]PendingTombstone, 0, len(entry.Removals))
+	for name, ts := range entry.Removals {
+		tombstones = append(tombstones, PendingTombstone{
+			Name:       name,
+			RemovedAt:  ts.RemovedAt,
+			Generation: ts.Generation,
+			Expired:    now.After(ts.RemovedAt.Add(ListingProxy_TombstoneTTL)),
+		})
+	}
+
+	return
+}
+
+// Invalidate drops any listing cached for the directory named by lp,
+// forcing the next call to List to go back to GCS rather than reuse a
+// cached listing, however fresh. It does not affect local overrides noted
+// via NoteNewObject, NoteNewSubdirectory, or NoteRemoval; callers that also
+// want those cleared should remove them individually.
+//
+// This is for callers with independent reason to believe the cached
+// listing is stale -- e.g. one who just wrote directly to GCS through some
+// path other than this ListingProxy and wants their own next List to
+// observe it rather than wait out ListingProxy_ListingCacheTTL.
+func (lp *ListingProxy) Invalidate() (err error) {
+	if err = lp.cache.Invalidate(lp.fullDirName()); err != nil {
+		err = fmt.Errorf("ListingCache.Invalidate: %v", err)
+	}
+
+	return
+}
+
+// listDirectory lists the immediate children of dir in bucket, paginating
+// as necessary and validating that everything GCS returns actually belongs
+// underneath dir.
+func listDirectory(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	dir string) (objects []*storage.Object, subdirs []string, err error) {
+	query := &storage.Query{
+		Delimiter: "/",
+		Prefix:    dir,
+	}
+
+	for {
+		var listing *storage.Objects
+		listing, err = bucket.ListObjects(ctx, query)
+		if err != nil {
+			err = &ListingError{Op: "List", Name: dir, Cause: err}
+			return
+		}
+
+		for _, o := range listing.Results {
+			// The directory itself shows up as a placeholder object with no
+			// content; it is not one of its own children.
+			if o.Name == dir {
+				continue
+			}
+
+			if !strings.HasPrefix(o.Name, dir) {
+				err = &ListingError{Op: "List", Name: o.Name, Cause: ErrNotDescendant}
+				return
+			}
+
+			if strings.HasSuffix(o.Name, "/") {
+				err = &ListingError{Op: "List", Name: o.Name, Cause: ErrIllegalObjectName}
+				return
+			}
+
+			objects = append(objects, o)
+		}
+
+		for _, p := range listing.Prefixes {
+			if !strings.HasPrefix(p, dir) {
+				err = &ListingError{Op: "List", Name: p, Cause: ErrNotDescendant}
+				return
+			}
+
+			if !strings.HasSuffix(p, "/") {
+				err = &ListingError{Op: "List", Name: p, Cause: ErrIllegalDirectoryName}
+				return
+			}
+
+			subdirs = append(subdirs, p)
+		}
+
+		if listing.Next == nil {
+			break
+		}
+
+		query = listing.Next
+	}
+
+	return
+}
+
+// NoteNewObject records the fact that an object with the given name is
+// believed to now exist as an immediate child of the directory named by lp,
+// overriding the result of future listings until another call to
+// NoteNewObject or NoteRemoval for the same name.
+func (lp *ListingProxy) NoteNewObject(o *storage.Object) (err error) {
+	name := o.Name
+	full := lp.bucketPrefix + name
+	fullDir := lp.fullDirName()
+
+	if !strings.HasPrefix(full, fullDir) {
+		err = &ListingError{Op: "NoteNewObject", Name: name, Cause: ErrNotDescendant}
+		return
+	}
+
+	if full == fullDir || strings.HasSuffix(name, "/") {
+		err = &ListingError{Op: "NoteNewObject", Name: name, Cause: ErrIllegalObjectName}
+		return
+	}
+
+	if err = lp.cache.NoteAddition(fullDir, name, o); err != nil {
+		err = fmt.Errorf("ListingCache.NoteAddition: %v", err)
+	}
+
+	return
+}
+
+// NoteNewSubdirectory records the fact that a sub-directory with the given
+// name is believed to now exist as an immediate child of the directory
+// named by lp, overriding the result of future listings until another call
+// to NoteNewSubdirectory or NoteRemoval for the same name.
+func (lp *ListingProxy) NoteNewSubdirectory(name string) (err error) {
+	full := lp.bucketPrefix + name
+	fullDir := lp.fullDirName()
+
+	if !strings.HasPrefix(full, fullDir) {
+		err = &ListingError{Op: "NoteNewSubdirectory", Name: name, Cause: ErrNotDescendant}
+		return
+	}
+
+	if !strings.HasSuffix(name, "/") {
+		err = &ListingError{Op: "NoteNewSubdirectory", Name: name, Cause: ErrIllegalSubDirectoryName}
+		return
+	}
+
+	if full == fullDir {
+		err = &ListingError{Op: "NoteNewSubdirectory", Name: name, Cause: ErrNotDescendant}
+		return
+	}
+
+	if rest := strings.TrimPrefix(full, fullDir); strings.Count(rest, "/") != 1 {
+		err = &ListingError{Op: "NoteNewSubdirectory", Name: name, Cause: ErrNotDirectDescendant}
+		return
+	}
+
+	if err = lp.cache.NoteAddition(fullDir, name, nil); err != nil {
+		err = fmt.Errorf("ListingCache.NoteAddition: %v", err)
+	}
+
+	return
+}
+
+// NoteRemoval records the fact that the object or sub-directory with the
+// given name is believed to no longer exist as an immediate child of the
+// directory named by lp. This plants a tombstone that hides the name from
+// List for ListingProxy_TombstoneTTL, overriding the result of future
+// listings until either the tombstone expires or another call to
+// NoteNewObject or NoteNewSubdirectory is made for the same name.
+//
+// The tombstone remembers the generation of the name most recently known to
+// this proxy (from a pending addition or a cached listing), if any. While
+// the tombstone is in effect, List only lets through objects GCS returns
+// with a strictly newer generation -- its best guess at "this name was
+// re-created after the removal we're hiding", as opposed to "GCS's index is
+// still stale". If no generation was known, the tombstone hides the name
+// unconditionally until it expires.
+//
+// Like NoteNewObject and NoteNewSubdirectory, this only affects the
+// immediate children of the directory named by lp; it has no effect on
+// listings of deeper descendants performed via ListRecursive.
+func (lp *ListingProxy) NoteRemoval(name string) (err error) {
+	fullDir := lp.fullDirName()
+
+	lp.refreshMu.Lock()
+	defer lp.refreshMu.Unlock()
+
+	gen := int64(unknownGeneration)
+	if entry, ok := lp.cache.Get(fullDir); ok {
+		if o, ok := entry.Additions[name]; ok {
+			gen = o.Generation
+		} else {
+			for _, o := range entry.Objects {
+				if o.Name == name {
+					gen = o.Generation
+					break
+				}
+			}
+		}
+	}
+
+	ts := Tombstone{
+		RemovedAt:  lp.clock.Now(),
+		Generation: gen,
+	}
+
+	if err = lp.cache.NoteRemoval(fullDir, name, ts); err != nil {
+		err = fmt.Errorf("ListingCache.NoteRemoval: %v", err)
+	}
+
+	return
+}
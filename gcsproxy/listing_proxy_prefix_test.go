@@ -0,0 +1,147 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jacobsa/gcloud/gcs/mock_gcs"
+	"github.com/jacobsa/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcsfuse/timeutil"
+	. "github.com/jacobsa/oglematchers"
+	"github.com/jacobsa/oglemock"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+func TestListingProxyForPrefix(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ListingProxyForPrefixTest struct {
+	bucketPrefix string
+	dirName      string
+	bucket       mock_gcs.MockBucket
+	clock        timeutil.SimulatedClock
+	lp           *gcsproxy.ListingProxy
+}
+
+var _ SetUpInterface = &ListingProxyForPrefixTest{}
+
+func init() { RegisterTestSuite(&ListingProxyForPrefixTest{}) }
+
+func (t *ListingProxyForPrefixTest) SetUp(ti *TestInfo) {
+	t.bucketPrefix = "tenants/a/"
+	t.dirName = "some/dir/"
+	t.bucket = mock_gcs.NewMockBucket(ti.MockController, "bucket")
+
+	var err error
+	t.lp, err = gcsproxy.NewListingProxyForPrefix(
+		t.bucket,
+		&t.clock,
+		t.bucketPrefix,
+		t.dirName)
+
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Test functions
+////////////////////////////////////////////////////////////////////////
+
+func (t *ListingProxyForPrefixTest) Name() {
+	ExpectEq(t.dirName, t.lp.Name())
+}
+
+func (t *ListingProxyForPrefixTest) CreateForIllegalBucketPrefix() {
+	_, err := gcsproxy.NewListingProxyForPrefix(
+		t.bucket,
+		&t.clock,
+		"tenants/a",
+		t.dirName)
+
+	AssertNe(nil, err)
+	ExpectTrue(errors.Is(err, gcsproxy.ErrIllegalDirectoryName))
+
+	var lerr *gcsproxy.ListingError
+	AssertTrue(errors.As(err, &lerr))
+	ExpectEq("tenants/a", lerr.Name)
+}
+
+func (t *ListingProxyForPrefixTest) List_UsesFullKeyAgainstGCS() {
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: t.bucketPrefix + t.dirName + "foo"},
+		},
+		Prefixes: []string{t.bucketPrefix + t.dirName + "bar/"},
+	}
+
+	var query *storage.Query
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Invoke(func(
+			ctx context.Context,
+			q *storage.Query) (*storage.Objects, error) {
+			query = q
+			return listing, nil
+		}))
+
+	objects, subdirs, err := t.lp.List(context.Background())
+	AssertEq(nil, err)
+
+	// GCS should have seen the full key, including bucketPrefix.
+	ExpectEq(t.bucketPrefix+t.dirName, query.Prefix)
+
+	// But the results returned to the caller should be relative to dirName,
+	// with bucketPrefix stripped.
+	AssertEq(1, len(objects))
+	ExpectEq(t.dirName+"foo", objects[0].Name)
+
+	AssertEq(1, len(subdirs))
+	ExpectEq(t.dirName+"bar/", subdirs[0])
+}
+
+func (t *ListingProxyForPrefixTest) NoteNewObject_RelativeName() {
+	ExpectEq(
+		nil,
+		t.lp.NoteNewObject(&storage.Object{Name: t.dirName + "foo"}))
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(&storage.Objects{}, nil))
+
+	objects, _, err := t.lp.List(context.Background())
+	AssertEq(nil, err)
+
+	AssertEq(1, len(objects))
+	ExpectEq(t.dirName+"foo", objects[0].Name)
+}
+
+func (t *ListingProxyForPrefixTest) NoteNewObject_NotDescendant() {
+	err := t.lp.NoteNewObject(&storage.Object{Name: "not/a/descendant"})
+	ExpectTrue(errors.Is(err, gcsproxy.ErrNotDescendant))
+}
+
+func (t *ListingProxyForPrefixTest) NoteRemoval_HidesName() {
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: t.bucketPrefix + t.dirName + "foo", Generation: 1},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	objects, _, err := t.lp.List(context.Background())
+	AssertEq(nil, err)
+	AssertEq(1, len(objects))
+
+	AssertEq(nil, t.lp.NoteRemoval(t.dirName+"foo"))
+
+	objects, _, err = t.lp.List(context.Background())
+	AssertEq(nil, err)
+	ExpectEq(0, len(objects))
+}
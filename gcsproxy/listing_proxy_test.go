@@ -6,6 +6,7 @@ package gcsproxy_test
 import (
 	"errors"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -83,6 +84,12 @@ func (lp *checkingListingProxy) NoteRemoval(name string) error {
 	return lp.wrapped.NoteRemoval(name)
 }
 
+func (lp *checkingListingProxy) Invalidate() error {
+	lp.wrapped.CheckInvariants()
+	defer lp.wrapped.CheckInvariants()
+	return lp.wrapped.Invalidate()
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Boilerplate
 ////////////////////////////////////////////////////////////////////////
@@ -122,8 +129,11 @@ func (t *ListingProxyTest) CreateForIllegalDirectoryName() {
 	_, err := gcsproxy.NewListingProxy(t.bucket, &t.clock, "foo/bar")
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("foo/bar")))
-	ExpectThat(err, Error(HasSubstr("directory name")))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrIllegalDirectoryName))
+
+	var lerr *gcsproxy.ListingError
+	AssertTrue(errors.As(err, &lerr))
+	ExpectEq("foo/bar", lerr.Name)
 }
 
 func (t *ListingProxyTest) Name() {
@@ -156,15 +166,15 @@ func (t *ListingProxyTest) List_CallsBucket() {
 
 func (t *ListingProxyTest) List_BucketFails() {
 	// Bucket.ListObjects
+	wantErr := errors.New("taco")
 	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
-		WillOnce(oglemock.Return(nil, errors.New("taco")))
+		WillOnce(oglemock.Return(nil, wantErr))
 
 	// List
 	_, _, err := t.lp.List()
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("List")))
-	ExpectThat(err, Error(HasSubstr("taco")))
+	ExpectTrue(errors.Is(err, wantErr))
 }
 
 func (t *ListingProxyTest) List_BucketReturnsIllegalObjectName() {
@@ -184,8 +194,11 @@ func (t *ListingProxyTest) List_BucketReturnsIllegalObjectName() {
 	_, _, err := t.lp.List()
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("object name")))
-	ExpectThat(err, Error(HasSubstr(badObj.Name)))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrIllegalObjectName))
+
+	var lerr *gcsproxy.ListingError
+	AssertTrue(errors.As(err, &lerr))
+	ExpectEq(badObj.Name, lerr.Name)
 }
 
 func (t *ListingProxyTest) List_BucketReturnsIllegalDirectoryName() {
@@ -205,8 +218,11 @@ func (t *ListingProxyTest) List_BucketReturnsIllegalDirectoryName() {
 	_, _, err := t.lp.List()
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("directory name")))
-	ExpectThat(err, Error(HasSubstr(badListing.Prefixes[1])))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrIllegalDirectoryName))
+
+	var lerr *gcsproxy.ListingError
+	AssertTrue(errors.As(err, &lerr))
+	ExpectEq(badListing.Prefixes[1], lerr.Name)
 }
 
 func (t *ListingProxyTest) List_BucketReturnsNonDescendantObject() {
@@ -226,9 +242,11 @@ func (t *ListingProxyTest) List_BucketReturnsNonDescendantObject() {
 	_, _, err := t.lp.List()
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("object")))
-	ExpectThat(err, Error(HasSubstr(badObj.Name)))
-	ExpectThat(err, Error(HasSubstr("descendant")))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrNotDescendant))
+
+	var lerr *gcsproxy.ListingError
+	AssertTrue(errors.As(err, &lerr))
+	ExpectEq(badObj.Name, lerr.Name)
 }
 
 func (t *ListingProxyTest) List_BucketReturnsNonDescendantPrefix() {
@@ -246,8 +264,11 @@ func (t *ListingProxyTest) List_BucketReturnsNonDescendantPrefix() {
 	_, _, err := t.lp.List()
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("some/other/dir/")))
-	ExpectThat(err, Error(HasSubstr("descendant")))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrNotDescendant))
+
+	var lerr *gcsproxy.ListingError
+	AssertTrue(errors.As(err, &lerr))
+	ExpectEq("some/other/dir/", lerr.Name)
 }
 
 func (t *ListingProxyTest) List_EmptyResult() {
@@ -385,6 +406,100 @@ func (t *ListingProxyTest) List_CacheHasExpired() {
 	t.lp.List()
 }
 
+func (t *ListingProxyTest) Invalidate_ForcesFreshListOnNextCall() {
+	// List successfully, populating the cache.
+	listing := &storage.Objects{}
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	_, _, err := t.lp.List()
+	AssertEq(nil, err)
+
+	// Without advancing the clock -- i.e. while the cached listing is still
+	// fresh by ListingProxy_ListingCacheTTL's reckoning -- invalidate it.
+	err = t.lp.Invalidate()
+	AssertEq(nil, err)
+
+	// The next List should nonetheless fall through to the bucket.
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	_, _, err = t.lp.List()
+	AssertEq(nil, err)
+}
+
+func (t *ListingProxyTest) Invalidate_PreservesLocalOverrides() {
+	o := &storage.Object{Name: t.dirName + "foo"}
+
+	// Note a local addition, with no listing ever having been cached.
+	err := t.lp.NoteNewObject(o)
+	AssertEq(nil, err)
+
+	err = t.lp.Invalidate()
+	AssertEq(nil, err)
+
+	// The addition should still override whatever the bucket reports.
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(&storage.Objects{}, nil))
+
+	objects, _, err := t.lp.List()
+
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre(o))
+}
+
+func (t *ListingProxyTest) List_ConcurrentStaleListsCoalesceOntoOneGCSRoundTrip() {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: t.dirName + "foo"},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Invoke(func(
+			ctx context.Context,
+			q *storage.Query) (*storage.Objects, error) {
+			close(started)
+			<-release
+			return listing, nil
+		}))
+
+	var wg sync.WaitGroup
+	var objectsA, objectsB []*storage.Object
+	var errA, errB error
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		objectsA, _, errA = t.lp.List()
+	}()
+
+	// Wait for the first call to be inside the mocked ListObjects before
+	// starting the second. Since the first call holds lp's refresh lock for
+	// the duration of that mocked call, the second call's own staleness
+	// check is guaranteed to lose the race and block on that lock rather
+	// than issue a second ListObjects call -- if it didn't, the single
+	// WillOnce expectation above would be violated.
+	<-started
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		objectsB, _, errB = t.lp.List()
+	}()
+
+	close(release)
+	wg.Wait()
+
+	AssertEq(nil, errA)
+	AssertEq(nil, errB)
+	ExpectThat(objectsA, ElementsAre(listing.Results[0]))
+	ExpectThat(objectsB, ElementsAre(listing.Results[0]))
+}
+
 func (t *ListingProxyTest) NoteNewObject_IllegalNames() {
 	var err error
 	try := func(name string) error {
@@ -395,22 +510,23 @@ func (t *ListingProxyTest) NoteNewObject_IllegalNames() {
 	err = try(t.dirName)
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("Illegal object name")))
-	ExpectThat(err, Error(HasSubstr(t.dirName)))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrIllegalObjectName))
 
 	// Sub-directory name
 	err = try(t.dirName + "subdir/")
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("Illegal object name")))
-	ExpectThat(err, Error(HasSubstr("subdir/")))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrIllegalObjectName))
 
 	// Non-descendant
 	err = try("some/other/dir/obj")
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("descendant")))
-	ExpectThat(err, Error(HasSubstr("some/other/dir/obj")))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrNotDescendant))
+
+	var lerr *gcsproxy.ListingError
+	AssertTrue(errors.As(err, &lerr))
+	ExpectEq("some/other/dir/obj", lerr.Name)
 }
 
 func (t *ListingProxyTest) NoteNewObject_NewListingRequired_NoConflict() {
@@ -603,29 +719,29 @@ func (t *ListingProxyTest) NoteNewSubdirectory_IllegalNames() {
 	err = try(t.dirName + "foo")
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("Illegal sub-directory name")))
-	ExpectThat(err, Error(HasSubstr("foo")))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrIllegalSubDirectoryName))
 
 	// Non-descendant
 	err = try("some/other/dir/")
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("descendant")))
-	ExpectThat(err, Error(HasSubstr("some/other/dir/")))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrNotDescendant))
+
+	var lerr *gcsproxy.ListingError
+	AssertTrue(errors.As(err, &lerr))
+	ExpectEq("some/other/dir/", lerr.Name)
 
 	// Equal to directory name
 	err = try(t.dirName)
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("descendant")))
-	ExpectThat(err, Error(HasSubstr(t.dirName)))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrNotDescendant))
 
 	// Descendant but not immediate
 	err = try(t.dirName + "subdir/other/")
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("direct descendant")))
-	ExpectThat(err, Error(HasSubstr("subdir/other/")))
+	ExpectTrue(errors.Is(err, gcsproxy.ErrNotDirectDescendant))
 }
 
 func (t *ListingProxyTest) NoteNewSubdirectory_NewListingRequired_NoConflict() {
@@ -780,21 +896,256 @@ func (t *ListingProxyTest) NoteNewSubdirectory_PreviousRemoval() {
 }
 
 func (t *ListingProxyTest) NoteRemoval_NoPreviousListing() {
-	AssertTrue(false, "TODO")
+	var err error
+	name := t.dirName + "foo"
+
+	// Mark removed before any listing has happened, so no generation is
+	// known for the tombstone.
+	err = t.lp.NoteRemoval(name)
+	AssertEq(nil, err)
+
+	// GCS still returns the object.
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: name, Generation: 1},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	objects, _, err := t.lp.List()
+
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre())
 }
 
 func (t *ListingProxyTest) NoteRemoval_PrevListingConflicts() {
-	AssertTrue(false, "TODO")
+	var err error
+	name := t.dirName + "foo"
+
+	// List once, seeing the object at generation 5.
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: name, Generation: 5},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	_, _, err = t.lp.List()
+	AssertEq(nil, err)
+
+	// Remove it. The tombstone should remember generation 5.
+	err = t.lp.NoteRemoval(name)
+	AssertEq(nil, err)
+
+	tombstones := t.lp.wrapped.PendingTombstones()
+	AssertEq(1, len(tombstones))
+	ExpectEq(name, tombstones[0].Name)
+	ExpectEq(5, tombstones[0].Generation)
+
+	// List again. The cache is still valid, so no round trip is needed, and
+	// the object should be gone.
+	objects, _, err := t.lp.List()
+
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre())
 }
 
 func (t *ListingProxyTest) NoteRemoval_PrevListingDoesntConflict() {
-	AssertTrue(false, "TODO")
+	var err error
+	name := t.dirName + "foo"
+
+	// List once, seeing nothing of interest.
+	listing := &storage.Objects{}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	_, _, err = t.lp.List()
+	AssertEq(nil, err)
+
+	// Remove a name that was never seen in a listing or noted as added.
+	err = t.lp.NoteRemoval(name)
+	AssertEq(nil, err)
+
+	tombstones := t.lp.wrapped.PendingTombstones()
+	AssertEq(1, len(tombstones))
+	ExpectEq(name, tombstones[0].Name)
+
+	// List again. Still nothing.
+	objects, _, err := t.lp.List()
+
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre())
 }
 
 func (t *ListingProxyTest) NoteRemoval_PreviousAddition() {
-	AssertTrue(false, "TODO")
+	var err error
+	name := t.dirName + "foo"
+
+	// Note an addition at generation 3.
+	err = t.lp.NoteNewObject(&storage.Object{Name: name, Generation: 3})
+	AssertEq(nil, err)
+
+	// Now remove it. The tombstone should pick up generation 3 from the
+	// pending addition, which should itself be forgotten.
+	err = t.lp.NoteRemoval(name)
+	AssertEq(nil, err)
+
+	tombstones := t.lp.wrapped.PendingTombstones()
+	AssertEq(1, len(tombstones))
+	ExpectEq(name, tombstones[0].Name)
+	ExpectEq(3, tombstones[0].Generation)
+
+	// A listing that returns that same generation should not resurrect it.
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: name, Generation: 3},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	objects, _, err := t.lp.List()
+
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre())
 }
 
 func (t *ListingProxyTest) NoteRemoval_PreviousRemoval() {
-	AssertTrue(false, "TODO")
+	var err error
+	name := t.dirName + "foo"
+
+	// Remove, then remove again before the tombstone would have expired.
+	err = t.lp.NoteRemoval(name)
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(gcsproxy.ListingProxy_TombstoneTTL - time.Millisecond)
+
+	err = t.lp.NoteRemoval(name)
+	AssertEq(nil, err)
+
+	// There should still be only one tombstone for the name.
+	tombstones := t.lp.wrapped.PendingTombstones()
+	AssertEq(1, len(tombstones))
+
+	// Advance close to the TTL again. If the second NoteRemoval hadn't reset
+	// the clock, the tombstone would already be expired by now.
+	t.clock.AdvanceTime(gcsproxy.ListingProxy_TombstoneTTL - time.Millisecond)
+
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: name, Generation: 1},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	objects, _, err := t.lp.List()
+
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre())
+}
+
+func (t *ListingProxyTest) NoteRemoval_NewerGenerationResurrects() {
+	var err error
+	name := t.dirName + "foo"
+
+	// List once, seeing the object at generation 5.
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: name, Generation: 5},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(listing, nil))
+
+	_, _, err = t.lp.List()
+	AssertEq(nil, err)
+
+	// Remove it. The tombstone should remember generation 5.
+	err = t.lp.NoteRemoval(name)
+	AssertEq(nil, err)
+
+	// Let the listing cache expire so the next List falls through to the
+	// bucket, which now reports a strictly newer generation for the same
+	// name -- as would happen if the name were re-created after the
+	// tombstone was recorded.
+	t.clock.AdvanceTime(gcsproxy.ListingProxy_ListingCacheTTL + time.Millisecond)
+
+	newListing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: name, Generation: 6},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Return(newListing, nil))
+
+	objects, _, err := t.lp.List()
+
+	AssertEq(nil, err)
+	ExpectThat(objects, ElementsAre(newListing.Results[0]))
+}
+
+func (t *ListingProxyTest) NoteRemoval_RacesConcurrentListRefresh() {
+	name := t.dirName + "foo"
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	listing := &storage.Objects{
+		Results: []*storage.Object{
+			&storage.Object{Name: name, Generation: 5},
+		},
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillOnce(oglemock.Invoke(func(
+			ctx context.Context,
+			q *storage.Query) (*storage.Objects, error) {
+			close(started)
+			<-release
+			return listing, nil
+		}))
+
+	var wg sync.WaitGroup
+	var listErr, removalErr error
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _, listErr = t.lp.List()
+	}()
+
+	// Wait for the List call to be inside the mocked ListObjects -- i.e. to
+	// be holding refreshMu -- before calling NoteRemoval. If NoteRemoval's
+	// read of the generation and its tombstone write weren't serialized
+	// against the same lock, it could run to completion in the gap between
+	// List's Get and Put, recording a tombstone with unknownGeneration
+	// instead of the generation 5 that List is about to observe.
+	<-started
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		removalErr = t.lp.NoteRemoval(name)
+	}()
+
+	close(release)
+	wg.Wait()
+
+	AssertEq(nil, listErr)
+	AssertEq(nil, removalErr)
+
+	tombstones := t.lp.wrapped.PendingTombstones()
+	AssertEq(1, len(tombstones))
+	ExpectEq(name, tombstones[0].Name)
+	ExpectEq(5, tombstones[0].Generation)
 }
@@ -0,0 +1,235 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+// The default bound on the number of ListObjects calls that a single
+// ListRecursive walk will have outstanding at once, used when
+// ListRecursiveOptions.MaxParallelism is zero.
+const defaultListRecursiveParallelism = 8
+
+// Options controlling a recursive walk performed by ListingProxy.ListRecursive.
+type ListRecursiveOptions struct {
+	// The maximum number of ListObjects calls that may be outstanding at
+	// once across the whole walk. Zero means use a sane default.
+	MaxParallelism int
+
+	// The maximum number of levels below the directory named by the
+	// ListingProxy to descend. Zero means unlimited.
+	MaxDepth int
+}
+
+// A single directory's worth of results from a call to ListRecursive. Dir is
+// relative to the same root as ListingProxy.Name: the bucket's root, or
+// bucketPrefix for a proxy created by NewListingProxyForPrefix.
+//
+// If Err is non-nil, listing Dir failed and Objects/Subdirs are empty; the
+// walk does not descend into Dir's children in that case.
+type ListRecursivePage struct {
+	Dir     string
+	Objects []*storage.Object
+	Subdirs []string
+	Err     error
+}
+
+// ListRecursive walks the tree of directories at and below the one named by
+// lp, listing each in turn and sending one ListRecursivePage per directory
+// visited on the returned channel. The channel is closed once the walk is
+// complete or ctx is cancelled.
+//
+// If ctx is cancelled (whether already-cancelled when ListRecursive is
+// called, or mid-walk), every in-flight walk goroutine stops descending
+// immediately rather than only once opts.MaxParallelism happens to be
+// saturated. Best effort is made to report the cancellation as a page with
+// Err set to ctx.Err() rather than silently dropping it, but that delivery
+// itself races against ctx.Done() like any other page send on this channel
+// -- a caller that needs a hard guarantee that cancellation was noticed
+// should prefer Walk, which checks ctx.Err() up front.
+//
+// Listings below lp's own directory are paginated internally (honoring the
+// cursor GCS returns) and cached for ListingProxy_WalkCacheTTL, same as a
+// flat List. The top-level directory reuses whatever List has already
+// cached, so a recent flat List() call can save the walk a round trip for
+// its first level.
+//
+// Fan-out into sub-directories is bounded by opts.MaxParallelism and
+// opts.MaxDepth. This does not change what NoteNewObject/NoteRemoval affect:
+// those calls still only ever apply to the immediate children of lp's own
+// directory.
+func (lp *ListingProxy) ListRecursive(
+	ctx context.Context,
+	opts ListRecursiveOptions) <-chan ListRecursivePage {
+	parallelism := opts.MaxParallelism
+	if parallelism <= 0 {
+		parallelism = defaultListRecursiveParallelism
+	}
+
+	pages := make(chan ListRecursivePage)
+	sem := make(chan struct{}, parallelism)
+
+	var wg sync.WaitGroup
+
+	sendCancellation := func(dir string) {
+		select {
+		case pages <- ListRecursivePage{Dir: dir, Err: ctx.Err()}:
+		case <-ctx.Done():
+		}
+	}
+
+	var walk func(dir string, depth int)
+	walk = func(dir string, depth int) {
+		defer wg.Done()
+
+		// Check explicitly rather than relying solely on the select below:
+		// with free parallelism slots, "sem <- struct{}{}" is immediately
+		// ready just as often as ctx.Done() is, so an already-cancelled ctx
+		// wouldn't reliably stop descent (or would stop it while reporting
+		// a misleadingly nil error) if we left this to chance.
+		if ctx.Err() != nil {
+			sendCancellation(dir)
+			return
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			sendCancellation(dir)
+			return
+		}
+
+		objects, subdirs, err := lp.listOneLevel(ctx, dir)
+		<-sem
+
+		select {
+		case pages <- ListRecursivePage{
+			Dir:     dir,
+			Objects: objects,
+			Subdirs: subdirs,
+			Err:     err,
+		}:
+		case <-ctx.Done():
+			sendCancellation(dir)
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+			return
+		}
+
+		for _, subdir := range subdirs {
+			wg.Add(1)
+			go walk(subdir, depth+1)
+		}
+	}
+
+	wg.Add(1)
+	go walk(lp.dirName, 0)
+
+	go func() {
+		wg.Wait()
+		close(pages)
+	}()
+
+	return pages
+}
+
+// Walk is a convenience wrapper around ListRecursive that calls visitor once
+// per directory in the walk, in no particular order, stopping and returning
+// the first error encountered (either from the walk itself or from
+// visitor). Cancelling ctx, whether before the call or mid-walk, is
+// guaranteed to be reflected in the returned error -- unlike a raw
+// ListRecursive page, this doesn't depend on winning a race to get a
+// cancellation page onto the channel.
+func (lp *ListingProxy) Walk(
+	ctx context.Context,
+	opts ListRecursiveOptions,
+	visitor func(dir string, objects []*storage.Object, subdirs []string) error) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	callerCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for page := range lp.ListRecursive(ctx, opts) {
+		if err != nil {
+			continue
+		}
+
+		if page.Err != nil {
+			err = page.Err
+			cancel()
+			continue
+		}
+
+		if visitErr := visitor(page.Dir, page.Objects, page.Subdirs); visitErr != nil {
+			err = visitErr
+			cancel()
+		}
+	}
+
+	if err == nil {
+		err = callerCtx.Err()
+	}
+
+	return
+}
+
+// listOneLevel lists the immediate children of dir, which must be lp's own
+// directory or a descendant of it. The top-level directory defers to List
+// so that a recent flat listing is reused; descendants get their own
+// entries in lp.cache, keyed like the top-level entry but judged fresh
+// against ListingProxy_WalkCacheTTL rather than ListingProxy_ListingCacheTTL.
+// Routing through lp.cache (rather than process-private state) means a
+// BboltListingCache- or RedisListingCache-backed proxy gets the same
+// restart-survival and cross-mount sharing for descendant levels of a walk
+// that it already gets for the top level.
+func (lp *ListingProxy) listOneLevel(
+	ctx context.Context,
+	dir string) (objects []*storage.Object, subdirs []string, err error) {
+	if dir == lp.dirName {
+		return lp.List(ctx)
+	}
+
+	fullDir := lp.bucketPrefix + dir
+
+	entry, ok := lp.cache.Get(fullDir)
+	fresh := ok && entry.HaveListing &&
+		!lp.clock.Now().After(entry.Timestamp.Add(ListingProxy_WalkCacheTTL))
+
+	if fresh {
+		return entry.Objects, entry.Subdirs, nil
+	}
+
+	objects, subdirs, err = listDirectory(ctx, lp.bucket, fullDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	objects = lp.relativizeObjects(objects)
+	subdirs = lp.relativizeSubdirs(subdirs)
+
+	if err = lp.cache.Put(fullDir, ListingCacheEntry{
+		HaveListing: true,
+		Objects:     objects,
+		Subdirs:     subdirs,
+		Timestamp:   lp.clock.Now(),
+	}, ListingProxy_WalkCacheTTL); err != nil {
+		return nil, nil, fmt.Errorf("ListingCache.Put: %v", err)
+	}
+
+	return objects, subdirs, nil
+}
@@ -0,0 +1,370 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy_test
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs/mock_gcs"
+	"github.com/jacobsa/gcsfuse/gcsproxy"
+	"github.com/jacobsa/gcsfuse/timeutil"
+	. "github.com/jacobsa/oglematchers"
+	"github.com/jacobsa/oglemock"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+func TestListingProxyWalk(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ListingProxyWalkTest struct {
+	dirName string
+	bucket  mock_gcs.MockBucket
+	clock   timeutil.SimulatedClock
+	lp      *gcsproxy.ListingProxy
+}
+
+var _ SetUpInterface = &ListingProxyWalkTest{}
+
+func init() { RegisterTestSuite(&ListingProxyWalkTest{}) }
+
+func (t *ListingProxyWalkTest) SetUp(ti *TestInfo) {
+	t.dirName = "some/dir/"
+	t.bucket = mock_gcs.NewMockBucket(ti.MockController, "bucket")
+
+	var err error
+	t.lp, err = gcsproxy.NewListingProxy(t.bucket, &t.clock, t.dirName)
+	AssertEq(nil, err)
+}
+
+// expectListings arranges for the bucket to answer ListObjects according to
+// listings, keyed by query.Prefix, recording every prefix queried in
+// *visited (guarded by a mutex, since walks query several directories
+// concurrently). A prefix with no entry in listings causes an error to be
+// returned, so that a directory the test didn't expect to be visited shows
+// up as a failure instead of silently succeeding.
+func (t *ListingProxyWalkTest) expectListings(
+	listings map[string]*storage.Objects,
+	visited *[]string,
+	mu *sync.Mutex) {
+	handler := func(
+		ctx context.Context,
+		q *storage.Query) (*storage.Objects, error) {
+		mu.Lock()
+		*visited = append(*visited, q.Prefix)
+		mu.Unlock()
+
+		listing, ok := listings[q.Prefix]
+		if !ok {
+			return nil, fmt.Errorf("unexpected ListObjects prefix: %q", q.Prefix)
+		}
+
+		return listing, nil
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillRepeatedly(oglemock.Invoke(handler))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Test functions
+////////////////////////////////////////////////////////////////////////
+
+func (t *ListingProxyWalkTest) MultiLevelFanOut_RespectsMaxDepth() {
+	listings := map[string]*storage.Objects{
+		t.dirName: {
+			Prefixes: []string{t.dirName + "a/", t.dirName + "b/"},
+		},
+		t.dirName + "a/": {
+			Prefixes: []string{t.dirName + "a/x/"},
+		},
+		t.dirName + "b/": {},
+	}
+
+	var mu sync.Mutex
+	var visited []string
+	t.expectListings(listings, &visited, &mu)
+
+	var visitMu sync.Mutex
+	var gotDirs []string
+	visitor := func(dir string, objects []*storage.Object, subdirs []string) error {
+		visitMu.Lock()
+		gotDirs = append(gotDirs, dir)
+		visitMu.Unlock()
+		return nil
+	}
+
+	err := t.lp.Walk(
+		context.Background(),
+		gcsproxy.ListRecursiveOptions{MaxDepth: 1},
+		visitor)
+
+	AssertEq(nil, err)
+
+	sort.Strings(gotDirs)
+	ExpectThat(
+		gotDirs,
+		ElementsAre(t.dirName, t.dirName+"a/", t.dirName+"b/"))
+}
+
+func (t *ListingProxyWalkTest) ErrorAtDirectory_HaltsDescentNotSiblings() {
+	wantErr := fmt.Errorf("taco")
+
+	handler := func(
+		ctx context.Context,
+		q *storage.Query) (*storage.Objects, error) {
+		switch q.Prefix {
+		case t.dirName:
+			return &storage.Objects{
+				Prefixes: []string{t.dirName + "good/", t.dirName + "bad/"},
+			}, nil
+
+		case t.dirName + "good/":
+			return &storage.Objects{
+				Prefixes: []string{t.dirName + "good/child/"},
+			}, nil
+
+		case t.dirName + "good/child/":
+			return &storage.Objects{}, nil
+
+		case t.dirName + "bad/":
+			return nil, wantErr
+
+		default:
+			return nil, fmt.Errorf("unexpected ListObjects prefix: %q", q.Prefix)
+		}
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillRepeatedly(oglemock.Invoke(handler))
+
+	pages := t.lp.ListRecursive(
+		context.Background(),
+		gcsproxy.ListRecursiveOptions{})
+
+	var gotDirs []string
+	var badErr error
+	for page := range pages {
+		gotDirs = append(gotDirs, page.Dir)
+		if page.Dir == t.dirName+"bad/" {
+			badErr = page.Err
+		}
+	}
+
+	sort.Strings(gotDirs)
+	ExpectThat(
+		gotDirs,
+		ElementsAre(
+			t.dirName,
+			t.dirName+"bad/",
+			t.dirName+"good/",
+			t.dirName+"good/child/"))
+
+	AssertNe(nil, badErr)
+	ExpectTrue(errors.Is(badErr, wantErr))
+}
+
+func (t *ListingProxyWalkTest) CtxCancellation_StopsFurtherDescent() {
+	started := make(chan string, 1)
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	var childPrefixesQueried []string
+
+	handler := func(
+		ctx context.Context,
+		q *storage.Query) (*storage.Objects, error) {
+		if q.Prefix == t.dirName {
+			return &storage.Objects{
+				Prefixes: []string{t.dirName + "a/", t.dirName + "b/"},
+			}, nil
+		}
+
+		mu.Lock()
+		childPrefixesQueried = append(childPrefixesQueried, q.Prefix)
+		mu.Unlock()
+
+		// Signal that this is the one child directory that managed to start
+		// listing, then sit here holding the walk's one parallelism slot
+		// until the test is done with it.
+		started <- q.Prefix
+		<-release
+
+		return &storage.Objects{}, nil
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillRepeatedly(oglemock.Invoke(handler))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pages := t.lp.ListRecursive(
+		ctx,
+		gcsproxy.ListRecursiveOptions{MaxParallelism: 1})
+
+	// The top-level directory is always listed first.
+	rootPage := <-pages
+	ExpectEq(t.dirName, rootPage.Dir)
+
+	// With only one parallelism slot, exactly one of "a/" and "b/" can have
+	// started listing by now; the other is stuck waiting for the slot.
+	// Cancelling at this point must stop the other one from ever calling
+	// ListObjects at all.
+	<-started
+	cancel()
+
+	// Let the one directory that was already in flight when we cancelled
+	// finish up, then drain the channel until it closes.
+	close(release)
+	for range pages {
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	AssertEq(1, len(childPrefixesQueried))
+	ExpectTrue(
+		childPrefixesQueried[0] == t.dirName+"a/" ||
+			childPrefixesQueried[0] == t.dirName+"b/")
+}
+
+func (t *ListingProxyWalkTest) CtxCancellation_MidWalk_SurfacesErrorFromWalk() {
+	started := make(chan string, 1)
+	release := make(chan struct{})
+
+	handler := func(
+		ctx context.Context,
+		q *storage.Query) (*storage.Objects, error) {
+		if q.Prefix == t.dirName {
+			return &storage.Objects{
+				Prefixes: []string{t.dirName + "a/", t.dirName + "b/"},
+			}, nil
+		}
+
+		// Signal that this is the one child directory that managed to start
+		// listing, then sit here holding the walk's one parallelism slot
+		// until the test cancels ctx and lets it go.
+		started <- q.Prefix
+		<-release
+
+		return &storage.Objects{}, nil
+	}
+
+	ExpectCall(t.bucket, "ListObjects")(Any(), Any()).
+		WillRepeatedly(oglemock.Invoke(handler))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	visitor := func(dir string, objects []*storage.Object, subdirs []string) error {
+		if dir == t.dirName {
+			// Wait for one child to be in flight, then cancel, before
+			// letting the walk proceed -- whether or not the resulting
+			// cancellation page wins its race onto the channel, Walk's
+			// return value must still reflect the cancellation.
+			<-started
+			cancel()
+			close(release)
+		}
+
+		return nil
+	}
+
+	err := t.lp.Walk(ctx, gcsproxy.ListRecursiveOptions{MaxParallelism: 1}, visitor)
+
+	ExpectTrue(errors.Is(err, context.Canceled))
+}
+
+func (t *ListingProxyWalkTest) CtxCancellation_AlreadyCancelled_SurfacesError() {
+	// No ExpectCall is registered for ListObjects: with plenty of free
+	// parallelism slots, a naive "select on sem vs. ctx.Done()" gate would
+	// often win the race and list the top-level directory anyway, so the
+	// absence of any matching expectation is itself part of the assertion.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	visited := 0
+	err := t.lp.Walk(
+		ctx,
+		gcsproxy.ListRecursiveOptions{},
+		func(dir string, objects []*storage.Object, subdirs []string) error {
+			visited++
+			return nil
+		})
+
+	ExpectTrue(errors.Is(err, context.Canceled))
+	ExpectEq(0, visited)
+}
+
+func (t *ListingProxyWalkTest) WalkCache_TTLReuse() {
+	listings := map[string]*storage.Objects{
+		t.dirName: {
+			Prefixes: []string{t.dirName + "sub/"},
+		},
+		t.dirName + "sub/": {
+			Results: []*storage.Object{
+				&storage.Object{Name: t.dirName + "sub/foo"},
+			},
+		},
+	}
+
+	var mu sync.Mutex
+	var visited []string
+	t.expectListings(listings, &visited, &mu)
+
+	drain := func() []string {
+		var dirs []string
+		pages := t.lp.ListRecursive(
+			context.Background(),
+			gcsproxy.ListRecursiveOptions{})
+
+		for page := range pages {
+			AssertEq(nil, page.Err)
+			dirs = append(dirs, page.Dir)
+		}
+
+		sort.Strings(dirs)
+		return dirs
+	}
+
+	// First walk: both directories are fetched from the bucket.
+	ExpectThat(drain(), ElementsAre(t.dirName, t.dirName+"sub/"))
+
+	mu.Lock()
+	AssertEq(2, len(visited))
+	visited = nil
+	mu.Unlock()
+
+	// Move into the future, but not quite far enough to expire either the
+	// top-level listing cache or "sub/"'s walk-cache entry.
+	t.clock.AdvanceTime(gcsproxy.ListingProxy_WalkCacheTTL - time.Millisecond)
+
+	// Second walk: both entries are still fresh, so no bucket round trips
+	// should be necessary.
+	ExpectThat(drain(), ElementsAre(t.dirName, t.dirName+"sub/"))
+
+	mu.Lock()
+	AssertEq(0, len(visited))
+	mu.Unlock()
+
+	// Move further into the future, well past the TTL of both entries (which
+	// were fetched during the first walk).
+	t.clock.AdvanceTime(gcsproxy.ListingProxy_WalkCacheTTL + time.Millisecond)
+
+	// Third walk: both entries have expired, so we should fall through to
+	// the bucket for each again.
+	ExpectThat(drain(), ElementsAre(t.dirName, t.dirName+"sub/"))
+
+	mu.Lock()
+	AssertEq(2, len(visited))
+	mu.Unlock()
+}